@@ -0,0 +1,173 @@
+package gitkit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+)
+
+// hookEnv is carried through a Backend call's context so execBackend can set
+// the GITKIT_* env vars the hook subsystem reads and the client's own "env"
+// requests, without widening the Backend interface itself.
+type hookEnv struct {
+	keyID     string
+	namespace string
+	repo      string
+	environ   []string
+}
+
+type hookEnvKey struct{}
+
+func withHookEnv(ctx context.Context, keyID, namespace, repo string, environ []string) context.Context {
+	return context.WithValue(ctx, hookEnvKey{}, hookEnv{keyID: keyID, namespace: namespace, repo: repo, environ: environ})
+}
+
+// Backend executes the three git-over-ssh protocols against a repository on
+// disk. repoPath is the fully resolved path to the repository (namespace
+// joined with repo name); stdin/stdout/stderr are wired directly to the SSH
+// channel so implementations can stream rather than buffer.
+type Backend interface {
+	UploadPack(ctx context.Context, repoPath string, stdin io.Reader, stdout, stderr io.Writer) error
+	ReceivePack(ctx context.Context, repoPath string, stdin io.Reader, stdout, stderr io.Writer) error
+	UploadArchive(ctx context.Context, repoPath string, stdin io.Reader, stdout, stderr io.Writer) error
+}
+
+// execBackend is the default Backend: it shells out to the git binary, same
+// as gitkit has always done.
+type execBackend struct{}
+
+// DefaultBackend shells out to the git binary, matching gitkit's historical
+// behavior.
+var DefaultBackend Backend = execBackend{}
+
+func (execBackend) run(ctx context.Context, name, repoPath string, stdin io.Reader, stdout, stderr io.Writer) error {
+	cmd := exec.CommandContext(ctx, name, repoPath)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if env, ok := ctx.Value(hookEnvKey{}).(hookEnv); ok {
+		cmd.Env = append(os.Environ(), env.environ...)
+		// Appended last: os/exec keeps only the last value for a duplicate
+		// key, so a client can't use its own "env" requests to spoof these.
+		cmd.Env = append(cmd.Env,
+			"GITKIT_KEY="+env.keyID,
+			"GITKIT_REPO="+env.repo,
+			"GITKIT_NAMESPACE="+env.namespace,
+		)
+	}
+
+	return cmd.Run()
+}
+
+func (b execBackend) UploadPack(ctx context.Context, repoPath string, stdin io.Reader, stdout, stderr io.Writer) error {
+	return b.run(ctx, "git-upload-pack", repoPath, stdin, stdout, stderr)
+}
+
+func (b execBackend) ReceivePack(ctx context.Context, repoPath string, stdin io.Reader, stdout, stderr io.Writer) error {
+	return b.run(ctx, "git-receive-pack", repoPath, stdin, stdout, stderr)
+}
+
+func (b execBackend) UploadArchive(ctx context.Context, repoPath string, stdin io.Reader, stdout, stderr io.Writer) error {
+	return b.run(ctx, "git-upload-archive", repoPath, stdin, stdout, stderr)
+}
+
+// GoGitBackend serves upload-pack and receive-pack using go-git's in-process
+// server-side transport instead of forking the git binary. This lets gitkit
+// run where a git binary isn't available, and puts gitkit itself in the pack
+// data path for auditing/scanning. go-git has no server-side implementation
+// of upload-archive, so that one command falls back to execBackend.
+type GoGitBackend struct {
+	loader server.Loader
+	fall   execBackend
+}
+
+// NewGoGitBackend returns a GoGitBackend rooted at the filesystem, using
+// go-git's default repository loader.
+func NewGoGitBackend() *GoGitBackend {
+	return &GoGitBackend{loader: server.DefaultLoader}
+}
+
+func (b *GoGitBackend) UploadPack(ctx context.Context, repoPath string, stdin io.Reader, stdout, stderr io.Writer) error {
+	ep, err := transport.NewEndpoint(repoPath)
+	if err != nil {
+		return fmt.Errorf("gogit: bad endpoint %q: %v", repoPath, err)
+	}
+
+	sess, err := server.NewServer(b.loader).NewUploadPackSession(ep, nil)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	ar, err := sess.AdvertisedReferences()
+	if err != nil {
+		return err
+	}
+	if err := ar.Encode(stdout); err != nil {
+		return err
+	}
+
+	// UploadPackRequest embeds UploadHaves, but that type only knows how to
+	// Encode (client side); there's no server-side API to decode haves off
+	// it. Decode just reads the want/shallow/deepen lines (promoted from the
+	// embedded UploadRequest) and hands the rest of the negotiation to the
+	// session itself, same as go-git's own server command plumbing does.
+	req := packp.NewUploadPackRequest()
+	if err := req.Decode(stdin); err != nil {
+		return fmt.Errorf("gogit: decoding upload-pack request: %v", err)
+	}
+
+	resp, err := sess.UploadPack(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return resp.Encode(stdout)
+}
+
+func (b *GoGitBackend) ReceivePack(ctx context.Context, repoPath string, stdin io.Reader, stdout, stderr io.Writer) error {
+	ep, err := transport.NewEndpoint(repoPath)
+	if err != nil {
+		return fmt.Errorf("gogit: bad endpoint %q: %v", repoPath, err)
+	}
+
+	sess, err := server.NewServer(b.loader).NewReceivePackSession(ep, nil)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	ar, err := sess.AdvertisedReferences()
+	if err != nil {
+		return err
+	}
+	if err := ar.Encode(stdout); err != nil {
+		return err
+	}
+
+	req := packp.NewReferenceUpdateRequest()
+	if err := req.Decode(stdin); err != nil {
+		return fmt.Errorf("gogit: decoding reference update request: %v", err)
+	}
+
+	status, err := sess.ReceivePack(ctx, req)
+	if err != nil {
+		return err
+	}
+	if status == nil {
+		return nil
+	}
+
+	return status.Encode(stdout)
+}
+
+func (b *GoGitBackend) UploadArchive(ctx context.Context, repoPath string, stdin io.Reader, stdout, stderr io.Writer) error {
+	return b.fall.UploadArchive(ctx, repoPath, stdin, stdout, stderr)
+}
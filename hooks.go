@@ -0,0 +1,164 @@
+package gitkit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RefUpdate describes a single <old-oid, new-oid, ref> triple as written by
+// git to the stdin of a pre-receive, update or post-receive hook.
+type RefUpdate struct {
+	Old string
+	New string
+	Ref string
+}
+
+// HookContext carries everything a registered HookFunc needs to know about
+// the push that triggered it.
+type HookContext struct {
+	Repo      string
+	Namespace string
+	KeyID     string
+	Hook      string // "pre-receive", "update" or "post-receive"
+	Updates   []RefUpdate
+}
+
+// HookFunc is a user-supplied callback invoked as a real git hook. Returning
+// a non-nil error rejects the push (for pre-receive/update) and its message
+// is relayed back to the client.
+type HookFunc func(ctx HookContext) error
+
+const hookEnvMarker = "GITKIT_HOOK"
+
+// hookNames lists the hooks gitkit installs and knows how to dispatch.
+var hookNames = []string{"pre-receive", "update", "post-receive"}
+
+// installHooks writes stub scripts for pre-receive, update and post-receive
+// into repoPath/hooks that re-exec the current binary with the "hook"
+// subcommand. The actual hook logic runs inside RunHook, driven by the
+// GITKIT_HOOK env var each stub exports and the GITKIT_REPO,
+// GITKIT_NAMESPACE and GITKIT_KEY env vars the SSH handler sets on the git
+// child process.
+func installHooks(repoPath string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("hooks: cannot resolve current executable: %v", err)
+	}
+
+	hooksDir := filepath.Join(repoPath, "hooks")
+	if err := os.MkdirAll(hooksDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	for _, name := range hookNames {
+		var script string
+		if name == "update" {
+			// Unlike pre-receive/post-receive, git invokes "update" once per
+			// ref with positional args (refname oldrev newrev) and writes
+			// nothing to its stdin; forward them through to RunHook.
+			script = fmt.Sprintf("#!/bin/sh\nexport %s=%s\nexec %q hook \"$@\"\n", hookEnvMarker, name, self)
+		} else {
+			script = fmt.Sprintf("#!/bin/sh\nexport %s=%s\nexec %q hook\n", hookEnvMarker, name, self)
+		}
+
+		path := filepath.Join(hooksDir, name)
+		if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+			return fmt.Errorf("hooks: writing %s: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// parseRefUpdates reads the <old> <new> <ref> lines git writes to a hook's
+// stdin.
+func parseRefUpdates(r io.Reader) ([]RefUpdate, error) {
+	var updates []RefUpdate
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("hooks: malformed ref update line: %q", line)
+		}
+
+		updates = append(updates, RefUpdate{Old: fields[0], New: fields[1], Ref: fields[2]})
+	}
+
+	return updates, scanner.Err()
+}
+
+// updateRefFromArgs builds the single RefUpdate an "update" hook receives as
+// positional args: os.Args is [self, "hook", refname, oldrev, newrev].
+func updateRefFromArgs(args []string) (RefUpdate, error) {
+	if len(args) < 5 {
+		return RefUpdate{}, fmt.Errorf("hooks: update hook expects refname oldrev newrev, got %v", args)
+	}
+
+	return RefUpdate{Ref: args[2], Old: args[3], New: args[4]}, nil
+}
+
+// RunHook is the entry point a binary embedding gitkit should call when it
+// detects it was re-exec'd as a hook (i.e. os.Args[1] == "hook"). It collects
+// the ref update(s) — from stdin for pre-receive/post-receive, from
+// positional args for update — builds a HookContext from the env vars set by
+// the SSH handler, and dispatches to the HookFunc registered on cfg for the
+// hook named in GITKIT_HOOK.
+func RunHook(cfg *config) error {
+	hook := os.Getenv(hookEnvMarker)
+
+	var fn HookFunc
+	switch hook {
+	case "pre-receive":
+		fn = cfg.PreReceiveFunc
+	case "update":
+		fn = cfg.UpdateFunc
+	case "post-receive":
+		fn = cfg.PostReceiveFunc
+	default:
+		return fmt.Errorf("hooks: unknown or missing %s: %q", hookEnvMarker, hook)
+	}
+
+	if fn == nil {
+		return nil
+	}
+
+	var updates []RefUpdate
+	if hook == "update" {
+		update, err := updateRefFromArgs(os.Args)
+		if err != nil {
+			return err
+		}
+		updates = []RefUpdate{update}
+	} else {
+		var err error
+		updates, err = parseRefUpdates(os.Stdin)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx := HookContext{
+		Repo:      os.Getenv("GITKIT_REPO"),
+		Namespace: os.Getenv("GITKIT_NAMESPACE"),
+		KeyID:     os.Getenv("GITKIT_KEY"),
+		Hook:      hook,
+		Updates:   updates,
+	}
+
+	if err := fn(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+
+	return nil
+}
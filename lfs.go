@@ -0,0 +1,56 @@
+package gitkit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+)
+
+// Regular expression matching the git-lfs-authenticate SSH command, sent by
+// the git-lfs client before it talks to the LFS HTTP API, e.g.:
+//
+//	ssh git@host git-lfs-authenticate myorg/repo.git upload
+var lfsCommandRegex = regexp.MustCompile(`^git-lfs-authenticate '?([^']+?)'? (upload|download)$`)
+
+// LFSAuthResponse is the JSON payload git-lfs-authenticate must print to
+// stdout, matching the shape the git-lfs client expects back from the LFS
+// SSH authentication API.
+type LFSAuthResponse struct {
+	Href      string            `json:"href"`
+	Header    map[string]string `json:"header,omitempty"`
+	ExpiresAt time.Time         `json:"expires_at,omitempty"`
+}
+
+// parseLFSCommand reports whether cmd is a git-lfs-authenticate request,
+// returning the repo path and operation ("upload" or "download") if so.
+func parseLFSCommand(cmd string) (repo, operation string, ok bool) {
+	matches := lfsCommandRegex.FindStringSubmatch(cmd)
+	if matches == nil {
+		return "", "", false
+	}
+	return matches[1], matches[2], true
+}
+
+// handleLFSAuthenticate answers a git-lfs-authenticate request using the
+// configured LFSAuthenticateFunc, writing the JSON response to w.
+func (s *SSH) handleLFSAuthenticate(keyID, repo, operation string, w io.Writer) error {
+	if s.config.LFSAuthenticateFunc == nil {
+		return fmt.Errorf("git-lfs-authenticate is not configured")
+	}
+
+	// repo comes straight off the raw SSH command; apply validateRepoPath,
+	// the path check the git-upload-pack/receive-pack path also applies,
+	// before it ever reaches a callback that's likely to join it onto a path.
+	if err := validateRepoPath(repo); err != nil {
+		return err
+	}
+
+	resp, err := s.config.LFSAuthenticateFunc(keyID, repo, operation)
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(w).Encode(resp)
+}
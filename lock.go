@@ -0,0 +1,84 @@
+package gitkit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// LockProvider serializes concurrent operations against the same repository.
+// Acquire blocks until the lock is free or timeout elapses, returning a
+// release func to call once the caller is done.
+type LockProvider interface {
+	Acquire(repo string, timeout time.Duration) (release func(), err error)
+}
+
+// repositoryLock is the default in-process LockProvider, keyed on
+// "namespace/repo". It serializes pushes to the same repository and caps how
+// many callers may queue up waiting for the lock.
+type repositoryLock struct {
+	mu       sync.Mutex
+	locks    map[string]*sync.Mutex
+	waiters  map[string]int
+	maxQueue int
+}
+
+// MaxQueuedWaiters is the default number of callers allowed to queue for a
+// given repository lock before Acquire fails fast instead of piling up.
+const MaxQueuedWaiters = 10
+
+// NewRepositoryLock returns the default in-process LockProvider.
+func NewRepositoryLock() LockProvider {
+	return &repositoryLock{
+		locks:    make(map[string]*sync.Mutex),
+		waiters:  make(map[string]int),
+		maxQueue: MaxQueuedWaiters,
+	}
+}
+
+func (r *repositoryLock) lockFor(repo string) *sync.Mutex {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	l, ok := r.locks[repo]
+	if !ok {
+		l = &sync.Mutex{}
+		r.locks[repo] = l
+	}
+	return l
+}
+
+func (r *repositoryLock) Acquire(repo string, timeout time.Duration) (func(), error) {
+	r.mu.Lock()
+	if r.waiters[repo] >= r.maxQueue {
+		r.mu.Unlock()
+		return nil, fmt.Errorf("lock: too many pending pushes for %q, try again later", repo)
+	}
+	r.waiters[repo]++
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		r.waiters[repo]--
+		r.mu.Unlock()
+	}()
+
+	l := r.lockFor(repo)
+
+	acquired := make(chan struct{})
+	go func() {
+		l.Lock()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		return l.Unlock, nil
+	case <-time.After(timeout):
+		go func() {
+			<-acquired
+			l.Unlock()
+		}()
+		return nil, fmt.Errorf("lock: timed out waiting for lock on %q", repo)
+	}
+}
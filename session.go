@@ -0,0 +1,51 @@
+package gitkit
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Session is handed to a Handler for each accepted "exec" request. It wraps
+// the raw SSH channel along with everything the default git handling needs:
+// the parsed command, the authenticated key id, and any environment
+// variables the client sent via "env" requests.
+type Session interface {
+	// Context is canceled once the client's SSH connection closes, so a
+	// long-running Handler can stop promptly instead of leaking. Closing
+	// only the channel does not cancel it while the Handler is running.
+	Context() context.Context
+	Command() *GitCommand
+	KeyID() string
+	Environ() []string
+	Stdin() io.Reader
+	Stdout() io.Writer
+	Stderr() io.Writer
+	Exit(code int) error
+}
+
+// Handler serves a single git-over-ssh request. Returning a non-nil error
+// relays the error text to the client and exits the session non-zero.
+type Handler func(Session) error
+
+type session struct {
+	ctx     context.Context
+	command *GitCommand
+	keyID   string
+	environ []string
+	ch      ssh.Channel
+}
+
+func (s *session) Context() context.Context { return s.ctx }
+func (s *session) Command() *GitCommand     { return s.command }
+func (s *session) KeyID() string            { return s.keyID }
+func (s *session) Environ() []string        { return s.environ }
+func (s *session) Stdin() io.Reader         { return s.ch }
+func (s *session) Stdout() io.Writer        { return s.ch }
+func (s *session) Stderr() io.Writer        { return s.ch.Stderr() }
+
+func (s *session) Exit(code int) error {
+	exitStatus(s.ch, uint32(code))
+	return nil
+}
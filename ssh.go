@@ -2,6 +2,7 @@ package gitkit
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,6 +13,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -19,6 +21,15 @@ import (
 // Regular expression to match incoming git-over-ssh commands
 var gitCommandRegex = regexp.MustCompile(`^(git[-|\s]upload-pack|git[-|\s]upload-archive|git[-|\s]receive-pack) '(.*)'$`)
 
+// allowedGitCommands is the dashed-form allow-list gitcmd.Command is checked
+// against; anything else is rejected before it ever reaches exec.Command or
+// a Backend.
+var allowedGitCommands = map[string]bool{
+	"git-upload-pack":    true,
+	"git-receive-pack":   true,
+	"git-upload-archive": true,
+}
+
 type PublicKey struct {
 	Id          string
 	Name        string
@@ -26,10 +37,47 @@ type PublicKey struct {
 	Content     string
 }
 
+// KeyUsageInfo describes the circumstances of a single use of an SSH key, so
+// callers can record things like "last used at" without reaching into the
+// SSH internals themselves.
+type KeyUsageInfo struct {
+	RemoteAddr    string
+	ClientVersion string
+	Command       *GitCommand
+	Timestamp     time.Time
+}
+
+// KeyUsedFunc is called whenever an SSH key authenticates, and again for
+// each git command it goes on to run.
+type KeyUsedFunc func(keyID string, info KeyUsageInfo)
+
 type SSH struct {
 	sshconfig           *ssh.ServerConfig
 	config              *config
 	PublicKeyLookupFunc func(string) (*PublicKey, error)
+	sessions            chan struct{}
+
+	// Handler serves each accepted git-over-ssh request. It defaults to
+	// defaultHandler, which runs auth, repo auto-create, push locking and
+	// the configured Backend. Set it to replace that behavior entirely.
+	Handler Handler
+}
+
+// DefaultLockTimeout bounds how long a push waits to acquire a repository's
+// lock before the client is told to go away and try again.
+const DefaultLockTimeout = 30 * time.Second
+
+// exitStatus writes the given SSH exit-status to the channel. A zero code
+// mirrors the existing success path; non-zero codes are used to surface
+// errors (lock timeouts, rejected hooks, etc.) instead of leaving the client
+// hanging.
+func exitStatus(ch ssh.Channel, code uint32) {
+	buf := make([]byte, 4)
+	buf[0] = byte(code >> 24)
+	buf[1] = byte(code >> 16)
+	buf[2] = byte(code >> 8)
+	buf[3] = byte(code)
+	ch.SendRequest("exit-status", false, buf)
 }
 
 type GitCommand struct {
@@ -44,18 +92,67 @@ func parseGitCommand(cmd string) (*GitCommand, error) {
 	if len(matches) == 0 {
 		return nil, fmt.Errorf("invalid git command")
 	}
+
+	// The regex accepts both the dashed ("git-upload-pack") and spaced
+	// ("git upload-pack") forms a client may send; normalize to the dashed
+	// form so it's both a valid binary name and matches allowedGitCommands.
+	command := strings.Replace(matches[0][1], " ", "-", -1)
+	if !allowedGitCommands[command] {
+		return nil, fmt.Errorf("invalid git command: %q is not allowed", command)
+	}
+
 	repoWithNamespace := matches[0][2]
+	if err := validateRepoPath(repoWithNamespace); err != nil {
+		return nil, err
+	}
+
 	splitRepo := strings.SplitAfter(repoWithNamespace, "/")
 	namespace := strings.Join(splitRepo[0:len(splitRepo)-1], "")
 	repo := splitRepo[len(splitRepo)-1]
 
-	return &GitCommand{namespace, matches[0][1], repo}, nil
+	if repo == "" || repo == "." || repo == ".." {
+		return nil, fmt.Errorf("invalid git command: repository path must name a repository")
+	}
+
+	return &GitCommand{namespace, command, repo}, nil
+}
+
+// validateRepoPath rejects repo paths that could escape s.config.Dir once
+// joined with it, or that collapse to the namespace/base directory itself
+// rather than naming a specific repository: absolute paths, "..' traversal,
+// "." / empty paths, and NUL bytes (which would otherwise let a client
+// truncate the path git/the OS actually sees).
+func validateRepoPath(repo string) error {
+	if repo == "" {
+		return fmt.Errorf("invalid git command: empty repository path")
+	}
+	if strings.ContainsRune(repo, 0) {
+		return fmt.Errorf("invalid git command: repository path contains a NUL byte")
+	}
+	if filepath.IsAbs(repo) {
+		return fmt.Errorf("invalid git command: repository path must be relative")
+	}
+
+	cleaned := filepath.Clean(repo)
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return fmt.Errorf("invalid git command: repository path must name a repository below the base directory")
+	}
+
+	return nil
 }
 
 func NewSSH(config config) *SSH {
 
 	s := &SSH{config: &config, PublicKeyLookupFunc: config.SSHPubKeyFunc}
 
+	if s.config.LockProvider == nil {
+		s.config.LockProvider = NewRepositoryLock()
+	}
+
+	if s.config.MaxConcurrentSessions > 0 {
+		s.sessions = make(chan struct{}, s.config.MaxConcurrentSessions)
+	}
+
 	return s
 }
 
@@ -89,7 +186,12 @@ func execCommand(cmdname string, args ...string) (string, string, error) {
 	return string(bufOut), string(bufErr), err
 }
 
-func (s *SSH) handleConnection(keyID string, chans <-chan ssh.NewChannel) {
+// handleConnection dispatches each channel of an already-authenticated SSH
+// connection. connCtx is canceled as soon as the underlying connection
+// closes (see ListenAndServe), so every per-channel session's Context() is
+// actually canceled on disconnect rather than only once its own goroutine
+// happens to return.
+func (s *SSH) handleConnection(connCtx context.Context, keyID, remoteAddr, clientVersion string, chans <-chan ssh.NewChannel) {
 	for newChan := range chans {
 		if newChan.ChannelType() != "session" {
 			newChan.Reject(ssh.UnknownChannelType, "unknown channel type")
@@ -102,8 +204,28 @@ func (s *SSH) handleConnection(keyID string, chans <-chan ssh.NewChannel) {
 			continue
 		}
 
+		if s.sessions != nil {
+			select {
+			case s.sessions <- struct{}{}:
+			default:
+				log.Printf("ssh: rejecting session, MaxConcurrentSessions reached")
+				ch.Write([]byte("Too many concurrent sessions, try again later.\r\n"))
+				exitStatus(ch, 1)
+				ch.Close()
+				continue
+			}
+		}
+
 		go func(in <-chan *ssh.Request) {
 			defer ch.Close()
+			if s.sessions != nil {
+				defer func() { <-s.sessions }()
+			}
+
+			ctx, cancel := context.WithCancel(connCtx)
+			defer cancel()
+
+			var environ []string
 
 			for req := range in {
 
@@ -119,11 +241,11 @@ func (s *SSH) handleConnection(keyID string, chans <-chan ssh.NewChannel) {
 
 					args[0] = strings.TrimLeft(args[0], "\x04")
 
-					_, _, err := execCommandBytes("env", args[0]+"="+args[1])
-					if err != nil {
-						log.Printf("env: %v", err)
-						return
-					}
+					// Previously this shelled out to `env VAR=VAL`, which set
+					// the var in a throwaway subprocess and had no effect on
+					// the git process started below. Collect it on the
+					// session instead so it can be threaded into cmd.Env.
+					environ = append(environ, args[0]+"="+args[1])
 				case "exec":
 					log.Printf("Received raw command: %s", payload)
 					cmdName := strings.TrimLeft(payload, "'()")
@@ -133,71 +255,51 @@ func (s *SSH) handleConnection(keyID string, chans <-chan ssh.NewChannel) {
 						cmdName = strings.Replace(cmdName, "\x00", "", -1)[1:]
 					}
 
-					gitcmd, err := parseGitCommand(cmdName)
-					if err != nil {
-						log.Println("ssh: error parsing command:", err)
-						ch.Write([]byte("Invalid command.\r\n"))
-						return
-					}
-
-					if s.config.SSHAuthFunc != nil {
-						cmdAuthorized, err := s.config.SSHAuthFunc(keyID, gitcmd)
-						if !cmdAuthorized || err != nil {
-							log.Println("ssh: command not authorized")
-							ch.Write([]byte("The command is not authorized for this repository.\r\n"))
-							return
-						}
-					}
-					log.Printf("Action on repo: %s", gitcmd.Repo)
-					if !repoExists(filepath.Join(s.config.Dir, gitcmd.Repo)) && s.config.AutoCreate == true && gitcmd.Command == "git-receive-pack" {
-						err := initRepo(gitcmd.Repo, s.config)
-						if err != nil {
-							logError("repo-init", err)
+					if repo, operation, ok := parseLFSCommand(cmdName); ok {
+						req.Reply(true, nil)
+						if err := s.handleLFSAuthenticate(keyID, repo, operation, ch); err != nil {
+							log.Printf("ssh: git-lfs-authenticate failed: %v", err)
+							ch.Write([]byte(err.Error() + "\r\n"))
+							exitStatus(ch, 1)
 							return
 						}
-					}
-
-					cmd := exec.Command(gitcmd.Command, gitcmd.Repo)
-					log.Printf("SSH running in namespace: %s repo: %s\n ", gitcmd.Namespace, gitcmd.Repo)
-					cmd.Dir = filepath.Join(s.config.Dir, gitcmd.Namespace)
-					log.Printf("Changed dir to %s", cmd.Dir)
-					cmd.Env = append(os.Environ(), "GITKIT_KEY="+keyID)
-					// cmd.Env = append(os.Environ(), "SSH_ORIGINAL_COMMAND="+cmdName)
-
-					stdout, err := cmd.StdoutPipe()
-					if err != nil {
-						log.Printf("ssh: cant open stdout pipe: %v", err)
+						exitStatus(ch, 0)
 						return
 					}
 
-					stderr, err := cmd.StderrPipe()
+					gitcmd, err := parseGitCommand(cmdName)
 					if err != nil {
-						log.Printf("ssh: cant open stderr pipe: %v", err)
+						log.Println("ssh: error parsing command:", err)
+						ch.Write([]byte("Invalid command.\r\n"))
 						return
 					}
 
-					input, err := cmd.StdinPipe()
-					if err != nil {
-						log.Printf("ssh: cant open stdin pipe: %v", err)
-						return
+					if s.config.KeyUsedFunc != nil {
+						s.config.KeyUsedFunc(keyID, KeyUsageInfo{
+							RemoteAddr:    remoteAddr,
+							ClientVersion: clientVersion,
+							Command:       gitcmd,
+							Timestamp:     time.Now(),
+						})
 					}
 
-					if err = cmd.Start(); err != nil {
-						log.Printf("ssh: start error: %v", err)
-						return
+					sess := &session{ctx: ctx, command: gitcmd, keyID: keyID, environ: environ, ch: ch}
+
+					handler := s.Handler
+					if handler == nil {
+						handler = s.defaultHandler
 					}
 
 					req.Reply(true, nil)
-					go io.Copy(input, ch)
-					io.Copy(ch, stdout)
-					io.Copy(ch.Stderr(), stderr)
 
-					if err = cmd.Wait(); err != nil {
+					if err := handler(sess); err != nil {
 						log.Printf("ssh: command failed: %v", err)
+						ch.Write([]byte(err.Error() + "\r\n"))
+						exitStatus(ch, 1)
 						return
 					}
 
-					ch.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
+					exitStatus(ch, 0)
 					return
 				default:
 					ch.Write([]byte("Unsupported request type.\r\n"))
@@ -209,6 +311,88 @@ func (s *SSH) handleConnection(keyID string, chans <-chan ssh.NewChannel) {
 	}
 }
 
+// defaultHandler is the Handler gitkit uses unless SSH.Handler is set: it
+// authorizes the command, auto-creates the repo and its hooks, serializes
+// pushes, and runs the configured Backend.
+func (s *SSH) defaultHandler(sess Session) error {
+	gitcmd := sess.Command()
+	keyID := sess.KeyID()
+
+	if s.config.SSHAuthFunc != nil {
+		cmdAuthorized, err := s.config.SSHAuthFunc(keyID, gitcmd)
+		if !cmdAuthorized || err != nil {
+			return fmt.Errorf("the command is not authorized for this repository")
+		}
+	}
+
+	log.Printf("Action on repo: %s", gitcmd.Repo)
+
+	nsDir := filepath.Join(s.config.Dir, gitcmd.Namespace)
+	if s.config.NamespaceResolver != nil {
+		resolved, err := s.config.NamespaceResolver(keyID, gitcmd.Namespace)
+		if err != nil {
+			return err
+		}
+		nsDir = resolved
+	}
+	repoFullPath := filepath.Join(nsDir, gitcmd.Repo)
+	log.Printf("SSH running in namespace: %s repo: %s\n ", gitcmd.Namespace, gitcmd.Repo)
+
+	if !repoExists(repoFullPath) && s.config.AutoCreate == true && gitcmd.Command == "git-receive-pack" {
+		// initRepo only knows how to create a repo under s.config.Dir; it has
+		// no way to target a NamespaceResolver's resolved directory. Rather
+		// than auto-create in the wrong place and then install hooks/push
+		// against a repo that was never actually initialized there, refuse
+		// the combination outright.
+		if s.config.NamespaceResolver != nil {
+			return fmt.Errorf("gitkit: AutoCreate is not supported together with a NamespaceResolver; create %q ahead of time", repoFullPath)
+		}
+
+		if err := initRepo(filepath.Join(gitcmd.Namespace, gitcmd.Repo), s.config); err != nil {
+			logError("repo-init", err)
+			return err
+		}
+
+		if err := installHooks(repoFullPath); err != nil {
+			logError("hook-install", err)
+			return err
+		}
+
+		if s.config.LFS {
+			if _, stderr, err := execCommandBytes("git", "-C", repoFullPath, "lfs", "install", "--local"); err != nil {
+				logError("lfs-install", fmt.Errorf("%v: %s", err, stderr))
+				return err
+			}
+		}
+	}
+
+	if gitcmd.Command == "git-receive-pack" {
+		release, err := s.config.LockProvider.Acquire(gitcmd.Namespace+"/"+gitcmd.Repo, DefaultLockTimeout)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	backend := s.config.Backend
+	if backend == nil {
+		backend = DefaultBackend
+	}
+
+	ctx := withHookEnv(sess.Context(), keyID, gitcmd.Namespace, gitcmd.Repo, sess.Environ())
+
+	switch gitcmd.Command {
+	case "git-upload-pack":
+		return backend.UploadPack(ctx, repoFullPath, sess.Stdin(), sess.Stdout(), sess.Stderr())
+	case "git-receive-pack":
+		return backend.ReceivePack(ctx, repoFullPath, sess.Stdin(), sess.Stdout(), sess.Stderr())
+	case "git-upload-archive":
+		return backend.UploadArchive(ctx, repoFullPath, sess.Stdin(), sess.Stdout(), sess.Stderr())
+	}
+
+	return fmt.Errorf("unsupported git command: %s", gitcmd.Command)
+}
+
 func (s *SSH) createServerKey() error {
 	if err := os.MkdirAll(s.config.KeyDir, os.ModePerm); err != nil {
 		return err
@@ -318,8 +502,32 @@ func (s *SSH) ListenAndServe(bind string) error {
 				keyID = sConn.Permissions.Extensions["key-id"]
 			}
 
+			remoteAddr := sConn.RemoteAddr().String()
+			clientVersion := string(sConn.ClientVersion())
+
+			if s.config.KeyUsedFunc != nil {
+				s.config.KeyUsedFunc(keyID, KeyUsageInfo{
+					RemoteAddr:    remoteAddr,
+					ClientVersion: clientVersion,
+					Timestamp:     time.Now(),
+				})
+			}
+
+			// connCtx is canceled the moment the underlying SSH connection
+			// closes (client disconnect, network drop, etc.), independent of
+			// whatever an in-flight Handler/Backend call is doing. This is
+			// what actually backs Session.Context()'s cancel-on-disconnect
+			// promise, rather than the per-channel goroutine's own deferred
+			// cancel, which only runs after that goroutine has already
+			// returned on its own.
+			connCtx, connCancel := context.WithCancel(context.Background())
+			go func() {
+				sConn.Wait()
+				connCancel()
+			}()
+
 			go ssh.DiscardRequests(reqs)
-			go s.handleConnection(keyID, chans)
+			go s.handleConnection(connCtx, keyID, remoteAddr, clientVersion, chans)
 		}()
 	}
 }